@@ -1,35 +1,94 @@
 package main
 
 import (
+	"bufio"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/kennylevinsen/serve2"
+	"github.com/kennylevinsen/serve2/metrics"
 	"github.com/kennylevinsen/serve2/proto"
 	"github.com/kennylevinsen/serve2/utils"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 var (
-	server    *serve2.Server
-	conf      Config
-	confReady bool
-	logger    func(string, ...interface{})
+	server     *serve2.Server
+	conf       Config
+	configPath string
+
+	// logger is read from arbitrary goroutines (every logInfo/logDebug call,
+	// from HTTP handlers to control-socket connections) and written from
+	// applyLogConfig on reload; loggerMu guards it so reads never tear an
+	// in-flight interface write.
+	logger   serve2.Logger
+	loggerMu sync.RWMutex
+
+	// reloadMu serializes reloadConfig, so that a SIGHUP racing a
+	// control-socket "reload" (or two control-socket reloads arriving close
+	// together) can't run the reload sequence concurrently and corrupt the
+	// package-level conf/logger or the order in which server fields are set.
+	reloadMu sync.Mutex
 )
 
+// currentLogger returns the active logger, safe for concurrent use with
+// setLogger.
+func currentLogger() serve2.Logger {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+	return logger
+}
+
+// setLogger installs l as the active logger and returns the previous one.
+func setLogger(l serve2.Logger) serve2.Logger {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+	old := logger
+	logger = l
+	return old
+}
+
 // Config is the top-level config
 type Config struct {
-	Address   string
-	LogStdout bool   `json:"logStdout,omitempty"`
-	LogFile   string `json:"logFile,omitempty"`
-	MaxRead   int    `json:"maxRead,omitempty"`
-	Protocols []Protocol
+	Address       string
+	MaxRead       int                 `json:"maxRead,omitempty"`
+	ControlSocket string              `json:"controlSocket,omitempty"`
+	Log           LogConfig           `json:"log,omitempty"`
+	ProxyProtocol ProxyProtocolConfig `json:"proxyProtocol,omitempty"`
+	Protocols     []Protocol
+}
+
+// ProxyProtocolConfig controls whether serve2d expects incoming connections
+// to be wrapped in a HAProxy PROXY protocol (v1 or v2) header, as placed by
+// an L4 load balancer in front of it.
+type ProxyProtocolConfig struct {
+	Accept       bool     `json:"accept,omitempty"`
+	TrustedCIDRs []string `json:"trustedCIDRs,omitempty"`
+}
+
+// LogConfig configures the structured logger used for both serve2d's own
+// startup/reload messages and, via server.Logger, the dispatch loop's
+// per-connection logging.
+type LogConfig struct {
+	Format string `json:"format,omitempty"` // "text" (default) or "json"
+	Level  string `json:"level,omitempty"`  // "info" (default) or "debug"
+	File   string `json:"file,omitempty"`
+	Stdout bool   `json:"stdout,omitempty"`
 }
 
 // Protocol is the part of config defining individual protocols
@@ -39,17 +98,292 @@ type Protocol struct {
 	Conf      map[string]interface{} `json:"conf,omitempty"`
 }
 
-func logit(format string, msg ...interface{}) {
-	defer func() {
-		if r := recover(); r != nil {
-			println("Log failed: ", r)
-			panic(r)
+// daemonLogger is serve2d's implementation of serve2.Logger. It is used both
+// for serve2d's own startup/reload messages and, once wired up as
+// server.Logger, for the dispatch loop's per-connection logging (fields such
+// as "remote", "handler", "sni", "alpn").
+type daemonLogger struct {
+	level  string
+	format string
+	out    io.Writer
+	file   *os.File // non-nil only when out is a file we opened ourselves
+}
+
+// newLogger builds a daemonLogger from a LogConfig.
+func newLogger(c LogConfig) (*daemonLogger, error) {
+	if c.Stdout && c.File != "" {
+		return nil, fmt.Errorf("unable to both log to stdout and to a file")
+	}
+
+	l := &daemonLogger{level: c.Level, format: c.Format}
+	if l.level == "" {
+		l.level = "info"
+	}
+	if l.format == "" {
+		l.format = "text"
+	}
+
+	switch {
+	case c.File != "":
+		f, err := os.OpenFile(c.File, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open logfile %s: %v", c.File, err)
 		}
-	}()
+		l.out = f
+		l.file = f
+	case c.Stdout:
+		l.out = os.Stdout
+	default:
+		l.out = os.Stderr
+	}
+
+	return l, nil
+}
+
+// close releases the logger's underlying file, if it opened one. It is a
+// no-op for loggers writing to stdout/stderr.
+func (l *daemonLogger) close() {
+	if l.file != nil {
+		l.file.Close()
+	}
+}
+
+// Debug implements serve2.Logger.
+func (l *daemonLogger) Debug(msg string, fields map[string]interface{}) {
+	if l.level != "debug" {
+		return
+	}
+	l.write("debug", msg, fields)
+}
+
+// Info implements serve2.Logger.
+func (l *daemonLogger) Info(msg string, fields map[string]interface{}) {
+	l.write("info", msg, fields)
+}
+
+func (l *daemonLogger) write(level, msg string, fields map[string]interface{}) {
+	now := time.Now().Format(time.RFC3339)
+
+	if l.format == "json" {
+		entry := make(map[string]interface{}, len(fields)+3)
+		for k, v := range fields {
+			entry[k] = v
+		}
+		entry["time"] = now
+		entry["level"] = level
+		entry["msg"] = msg
+
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+		fmt.Fprintln(l.out, string(b))
+		return
+	}
+
+	line := fmt.Sprintf("%s [%s] %s", now, level, msg)
+	for k, v := range fields {
+		line += fmt.Sprintf(" %s=%v", k, v)
+	}
+	fmt.Fprintln(l.out, line)
+}
+
+// logInfo and logDebug are the package-wide logging entry points. Before the
+// configured logger is ready, logInfo falls back to the standard logger so
+// that early startup errors are never silently dropped; logDebug messages are
+// discarded until then.
+func logInfo(msg string, fields map[string]interface{}) {
+	if l := currentLogger(); l != nil {
+		l.Info(msg, fields)
+		return
+	}
+	if len(fields) > 0 {
+		log.Println(msg, fields)
+		return
+	}
+	log.Println(msg)
+}
+
+func logDebug(msg string, fields map[string]interface{}) {
+	if l := currentLogger(); l != nil {
+		l.Debug(msg, fields)
+	}
+}
+
+// parseTLSRoute turns a single entry of a "tls" handler's "routes" (or
+// "default") declaration into a proto.TLSRoute. Missing serverNames/alpn
+// means "match anything"; cert/key default to the handler's own.
+func parseTLSRoute(raw interface{}) proto.TLSRoute {
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		panic("TLS route declaration invalid")
+	}
+
+	route := proto.TLSRoute{}
+
+	if sn, ok := m["serverNames"].([]interface{}); ok {
+		route.ServerNames = make([]string, len(sn))
+		for i, x := range sn {
+			s, ok := x.(string)
+			if !ok {
+				panic("TLS route serverNames declaration invalid")
+			}
+			route.ServerNames[i] = s
+		}
+	}
+
+	if a, ok := m["alpn"].([]interface{}); ok {
+		route.ALPN = make([]string, len(a))
+		for i, x := range a {
+			s, ok := x.(string)
+			if !ok {
+				panic("TLS route alpn declaration invalid")
+			}
+			route.ALPN[i] = s
+		}
+	}
+
+	target, ok := m["target"].(string)
+	if !ok {
+		panic("TLS route declaration is missing valid target")
+	}
+	route.Target = target
 
-	if logger != nil || !confReady {
-		log.Printf(format, msg...)
+	if p, ok := m["protocol"].(string); ok {
+		route.Protocol = p
 	}
+
+	if c, ok := m["cert"].(string); ok {
+		route.Cert = c
+	}
+
+	if k, ok := m["key"].(string); ok {
+		route.Key = k
+	}
+
+	return route
+}
+
+// buildAutocertManager turns a "tls" handler's "acme" declaration into an
+// autocert.Manager that obtains and renews certificates for the listed
+// hostnames via TLS-ALPN-01.
+func buildAutocertManager(conf map[string]interface{}) (*autocert.Manager, error) {
+	hnRaw, ok := conf["hostnames"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("acme declaration is missing valid hostnames")
+	}
+
+	hostnames := make([]string, len(hnRaw))
+	for i, x := range hnRaw {
+		s, ok := x.(string)
+		if !ok {
+			return nil, fmt.Errorf("acme hostnames declaration invalid")
+		}
+		hostnames[i] = s
+	}
+
+	mgr := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hostnames...),
+	}
+
+	if email, ok := conf["email"].(string); ok {
+		mgr.Email = email
+	}
+
+	if cacheDir, ok := conf["cacheDir"].(string); ok {
+		mgr.Cache = autocert.DirCache(cacheDir)
+	}
+
+	if directoryURL, ok := conf["directoryURL"].(string); ok {
+		mgr.Client = &acme.Client{DirectoryURL: directoryURL}
+	}
+
+	return mgr, nil
+}
+
+// parseSendProxyProto reads the optional "sendProxyProtocol" ("v1" or "v2")
+// shared by the proxy/tlsmatcher kinds, controlling whether a PROXY protocol
+// header is prepended to the outbound stream.
+func parseSendProxyProto(conf map[string]interface{}) utils.ProxyProtoVersion {
+	s, ok := conf["sendProxyProtocol"].(string)
+	if !ok {
+		return utils.ProxyProtoNone
+	}
+
+	switch s {
+	case "v1":
+		return utils.ProxyProtoV1
+	case "v2":
+		return utils.ProxyProtoV2
+	default:
+		panic("sendProxyProtocol declaration invalid: " + s)
+	}
+}
+
+// parseCIDRStrings parses the proxyProtocol.trustedCIDRs list.
+func parseCIDRStrings(ss []string, field string) ([]*net.IPNet, error) {
+	if len(ss) == 0 {
+		return nil, nil
+	}
+
+	nets := make([]*net.IPNet, len(ss))
+	for i, s := range ss {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s contains invalid CIDR %q: %v", field, s, err)
+		}
+		nets[i] = n
+	}
+
+	return nets, nil
+}
+
+// parseAccessControl builds the allowedNets/deniedNets/authFile block shared
+// by the forward-proxying handlers (httpconnect, socks5).
+func parseAccessControl(conf map[string]interface{}) proto.AccessControl {
+	ac := proto.AccessControl{}
+
+	ac.AllowedNets = parseNets(conf["allowedNets"], "allowedNets")
+	ac.DeniedNets = parseNets(conf["deniedNets"], "deniedNets")
+
+	if f, ok := conf["authFile"]; ok {
+		ac.AuthFile, ok = f.(string)
+		if !ok {
+			panic("authFile declaration invalid")
+		}
+	}
+
+	return ac
+}
+
+// parseNets parses a JSON array of CIDR strings, as used by allowedNets and
+// deniedNets. A missing key yields a nil slice, meaning "no restriction".
+func parseNets(raw interface{}, field string) []*net.IPNet {
+	if raw == nil {
+		return nil
+	}
+
+	l, ok := raw.([]interface{})
+	if !ok {
+		panic(field + " declaration invalid")
+	}
+
+	nets := make([]*net.IPNet, len(l))
+	for i, x := range l {
+		s, ok := x.(string)
+		if !ok {
+			panic(field + " declaration invalid")
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(field + " contains invalid CIDR: " + s)
+		}
+		nets[i] = n
+	}
+
+	return nets
 }
 
 type httpHandler struct {
@@ -72,7 +406,7 @@ func (h httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	content, err := ioutil.ReadFile(p)
 	if err != nil {
-		logit("http could not read file %s: %v", p, err)
+		logInfo("http could not read file", map[string]interface{}{"path": p, "err": err})
 		w.WriteHeader(404)
 		fmt.Fprintf(w, "%s", h.notFoundMsg)
 		return
@@ -81,68 +415,61 @@ func (h httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s", content)
 }
 
-func main() {
-	defer func() {
-		if err := recover(); err != nil {
-			logit("Panicked: %s", err)
-		}
-	}()
-
-	if len(os.Args) <= 1 {
-		panic("Missing configuration path")
-	}
-
-	path := os.Args[1]
-
+// LoadConfig reads and parses the configuration file at path, and builds the
+// protocol handler set it describes. It is safe to call repeatedly (e.g. on
+// a reload): a malformed configuration is returned as an error rather than
+// panicking the caller, and the package-level conf is only replaced once the
+// new configuration has been fully validated, parsed and built.
+func LoadConfig(path string) ([]serve2.ProtocolHandler, *serve2.ProtocolHandler, error) {
 	bytes, err := ioutil.ReadFile(path)
 	if err != nil {
-		logit("Reading configuration failed")
-		panic(err)
+		return nil, nil, fmt.Errorf("reading configuration failed: %v", err)
 	}
 
-	err = json.Unmarshal(bytes, &conf)
-	if err != nil {
-		logit("Parsing configuration failed")
-		panic(err)
+	var c Config
+	if err := json.Unmarshal(bytes, &c); err != nil {
+		return nil, nil, fmt.Errorf("parsing configuration failed: %v", err)
 	}
 
-	confReady = true
-
-	server = serve2.New()
-
-	if conf.LogStdout && conf.LogFile != "" {
-		panic("Unable to both log to stdout and to logfile")
+	handlers, def, err := buildHandlers(c)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if conf.LogStdout || conf.LogFile != "" {
-		if conf.LogFile != "" {
-			file, err := os.OpenFile(conf.LogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-			if err != nil {
-				logit("Failed to open logfile: %s", conf.LogFile)
-				panic(err)
-			}
-			log.SetOutput(file)
+	if c.ProxyProtocol.Accept {
+		if _, err := parseCIDRStrings(c.ProxyProtocol.TrustedCIDRs, "proxyProtocol.trustedCIDRs"); err != nil {
+			return nil, nil, err
 		}
-
-		logger = log.Printf
-		server.Logger = log.Printf
 	}
 
-	if conf.MaxRead != 0 {
-		server.BytesToCheck = conf.MaxRead
+	// Build (and immediately discard) a logger from c.Log purely to
+	// validate it; applyLogConfig constructs the real one it applies once
+	// conf has been committed. This keeps "conf is only replaced once fully
+	// validated" true for the log config too, not just proxyProtocol.
+	l, err := newLogger(c.Log)
+	if err != nil {
+		return nil, nil, fmt.Errorf("log configuration failed: %v", err)
 	}
+	l.close()
 
-	logit("Maximum buffer size: %d", server.BytesToCheck)
+	conf = c
 
-	l, err := net.Listen("tcp", conf.Address)
-	if err != nil {
-		logit("Listen on [%s] failed", conf.Address)
-		panic(err)
-	}
+	return handlers, def, nil
+}
 
-	logit("Listening on: %s", conf.Address)
+// buildHandlers turns a parsed Config's Protocols list into the
+// serve2.ProtocolHandler set the server should run with. Configuration
+// mistakes are reported as errors instead of panicking, so that a bad
+// reload doesn't take down an already-running daemon.
+func buildHandlers(c Config) (handlers []serve2.ProtocolHandler, def *serve2.ProtocolHandler, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			handlers, def = nil, nil
+			err = fmt.Errorf("%v", r)
+		}
+	}()
 
-	for _, v := range conf.Protocols {
+	for _, v := range c.Protocols {
 		var (
 			handler serve2.ProtocolHandler
 			err     error
@@ -160,8 +487,10 @@ func main() {
 				panic("Proxy declaration is missing valid target")
 			}
 
+			sendProxyProto := parseSendProxyProto(v.Conf)
+
 			if mok {
-				handler = proto.NewProxy([]byte(magic), "tcp", target)
+				handler = proto.NewProxy([]byte(magic), "tcp", target, sendProxyProto)
 			} else {
 				magics := make([][]byte, len(magicSlice))
 				for i := range magicSlice {
@@ -171,19 +500,9 @@ func main() {
 					}
 					magics[i] = []byte(magic)
 				}
-				handler = proto.NewMultiProxy(magics, "tcp", target)
+				handler = proto.NewMultiProxy(magics, "tcp", target, sendProxyProto)
 			}
 		case "tls":
-			cert, ok := v.Conf["cert"].(string)
-			if !ok {
-				panic("TLS declaration is missing valid certificate")
-			}
-
-			key, ok := v.Conf["key"].(string)
-			if !ok {
-				panic("TLS declaration is missing valid key")
-			}
-
 			var protos []string
 			y, ok := v.Conf["protos"].([]interface{})
 			if !ok {
@@ -198,10 +517,62 @@ func main() {
 				protos = append(protos, proto)
 			}
 
-			handler, err = proto.NewTLS(protos, cert, key)
-			if err != nil {
-				logit("TLS configuration failed")
-				panic(err)
+			var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+			if ac, ok := v.Conf["acme"].(map[string]interface{}); ok {
+				mgr, err := buildAutocertManager(ac)
+				if err != nil {
+					logInfo("acme configuration failed", map[string]interface{}{"err": err})
+					panic(err)
+				}
+
+				// ClientHellos carrying the acme-tls/1 ALPN are routed
+				// straight into autocert's TLS-ALPN-01 challenge path,
+				// bypassing the normal handler matching.
+				protos = append([]string{acme.ALPNProto}, protos...)
+				getCertificate = mgr.GetCertificate
+			}
+
+			// cert/key are only mandatory when there's no acme manager to
+			// fall back on for certificate issuance; with acme configured,
+			// an empty cert/key (or per-route cert/key) is fine since
+			// getCertificate supplies the certificate instead.
+			cert, certOk := v.Conf["cert"].(string)
+			if v.Conf["cert"] != nil && !certOk {
+				panic("TLS declaration has invalid certificate")
+			}
+
+			key, keyOk := v.Conf["key"].(string)
+			if v.Conf["key"] != nil && !keyOk {
+				panic("TLS declaration has invalid key")
+			}
+
+			if getCertificate == nil && (cert == "" || key == "") {
+				panic("TLS declaration is missing valid certificate/key")
+			}
+
+			if rc, ok := v.Conf["routes"].([]interface{}); ok {
+				routes := make([]proto.TLSRoute, len(rc))
+				for i, r := range rc {
+					routes[i] = parseTLSRoute(r)
+				}
+
+				var defaultRoute *proto.TLSRoute
+				if dc, ok := v.Conf["default"].(map[string]interface{}); ok {
+					d := parseTLSRoute(dc)
+					defaultRoute = &d
+				}
+
+				handler, err = proto.NewTLSRouter(cert, key, protos, routes, defaultRoute, getCertificate)
+				if err != nil {
+					logInfo("tls router configuration failed", map[string]interface{}{"err": err})
+					panic(err)
+				}
+			} else {
+				handler, err = proto.NewTLS(protos, cert, key, getCertificate)
+				if err != nil {
+					logInfo("tls configuration failed", map[string]interface{}{"err": err})
+					panic(err)
+				}
 			}
 		case "tlsmatcher":
 			target, ok := v.Conf["target"].(string)
@@ -209,11 +580,13 @@ func main() {
 				panic("TLSMatcher declaration is missing valid target")
 			}
 
+			sendProxyProto := parseSendProxyProto(v.Conf)
+
 			var cb func(net.Conn) (net.Conn, error)
 			dialTLS, ok := v.Conf["dialTLS"].(bool)
 			if !ok || !dialTLS {
 				cb = func(c net.Conn) (net.Conn, error) {
-					return nil, utils.DialAndProxy(c, "tcp", target)
+					return nil, utils.DialAndProxy(c, "tcp", target, sendProxyProto)
 				}
 			} else {
 				cb = func(c net.Conn) (net.Conn, error) {
@@ -232,7 +605,7 @@ func main() {
 						ServerName:         serverName,
 						NextProtos:         []string{proto},
 						InsecureSkipVerify: true,
-					})
+					}, sendProxyProto)
 				}
 			}
 
@@ -294,7 +667,7 @@ func main() {
 
 				x, err := ioutil.ReadFile(f)
 				if err != nil {
-					logit("HTTP unable to open notFoundFile")
+					logInfo("http unable to open notFoundFile", map[string]interface{}{"err": err})
 					panic(err)
 				}
 				h.notFoundMsg = string(x)
@@ -316,6 +689,19 @@ func main() {
 			}
 
 			handler = proto.NewHTTP(h)
+		case "httpconnect":
+			handler = proto.NewHTTPConnect(parseAccessControl(v.Conf))
+		case "socks5":
+			handler = proto.NewSOCKS5(parseAccessControl(v.Conf))
+		case "metrics":
+			p, ok := v.Conf["path"].(string)
+			if !ok {
+				p = "/metrics"
+			}
+
+			mux := http.NewServeMux()
+			mux.Handle(p, promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+			handler = proto.NewHTTP(mux)
 		case "echo":
 			handler = proto.NewEcho()
 		case "discard":
@@ -325,14 +711,178 @@ func main() {
 		}
 
 		if v.AsDefault {
-			server.DefaultProtocol = handler
+			h := handler
+			def = &h
 		} else {
-			server.AddHandler(handler)
+			handlers = append(handlers, handler)
+		}
+	}
+
+	return handlers, def, nil
+}
+
+// applyLogConfig wires up logging according to the currently loaded conf. It
+// is re-run on every reload so that reopening the log file (as part of log
+// rotation) doesn't require restarting the daemon.
+func applyLogConfig() error {
+	l, err := newLogger(conf.Log)
+	if err != nil {
+		return err
+	}
+
+	old := setLogger(l)
+
+	server.Lock()
+	server.Logger = l
+	server.Unlock()
+
+	if dl, ok := old.(*daemonLogger); ok {
+		dl.close()
+	}
+
+	return nil
+}
+
+// reloadConfig (re-)reads the configuration file at configPath, rebuilds the
+// protocol handler set, and atomically swaps it into the running server.
+// Connections already being served keep using their current handler; only
+// new connections see the reloaded set. reloadMu serializes the whole
+// sequence against concurrent triggers (SIGHUP racing a control-socket
+// reload, or several control-socket reloads in a row); the server.Lock calls
+// guard the fields the dispatch loop reads per-connection, the same lock
+// ReplaceHandlers takes internally for the handler set itself.
+func reloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	handlers, def, err := LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	var trustedCIDRs []*net.IPNet
+	if conf.ProxyProtocol.Accept {
+		trustedCIDRs, err = parseCIDRStrings(conf.ProxyProtocol.TrustedCIDRs, "proxyProtocol.trustedCIDRs")
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := applyLogConfig(); err != nil {
+		return err
+	}
+
+	server.Lock()
+	if conf.MaxRead != 0 {
+		server.BytesToCheck = conf.MaxRead
+	}
+	server.AcceptProxyProto = conf.ProxyProtocol.Accept
+	server.ProxyProtoTrustedCIDRs = trustedCIDRs
+	server.Unlock()
+
+	var defaultHandler serve2.ProtocolHandler
+	if def != nil {
+		defaultHandler = *def
+	}
+
+	server.ReplaceHandlers(handlers, defaultHandler)
+
+	logInfo("configuration (re)loaded", map[string]interface{}{"handlers": len(handlers)})
+	return nil
+}
+
+// serveControlSocket listens on a Unix domain socket at path, accepting
+// line-based commands ("reload") used to trigger the same reload as SIGHUP
+// without having to signal the process directly.
+func serveControlSocket(path string) {
+	os.Remove(path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		logInfo("control socket listen failed", map[string]interface{}{"path": path, "err": err})
+		return
+	}
+	defer l.Close()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			logInfo("control socket accept failed", map[string]interface{}{"err": err})
+			return
+		}
+
+		go handleControlConn(c)
+	}
+}
+
+func handleControlConn(c net.Conn) {
+	defer c.Close()
+
+	cmd, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	switch strings.TrimSpace(cmd) {
+	case "reload":
+		if err := reloadConfig(); err != nil {
+			logInfo("reloading configuration failed", map[string]interface{}{"err": err})
+			fmt.Fprintf(c, "error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(c, "ok\n")
+	default:
+		fmt.Fprintf(c, "unknown command: %s\n", cmd)
+	}
+}
+
+func main() {
+	defer func() {
+		if err := recover(); err != nil {
+			logInfo("panicked", map[string]interface{}{"err": err})
+		}
+	}()
+
+	if len(os.Args) <= 1 {
+		panic("Missing configuration path")
+	}
+
+	configPath = os.Args[1]
+
+	server = serve2.New()
+
+	if err := reloadConfig(); err != nil {
+		logInfo("loading configuration failed", map[string]interface{}{"err": err})
+		panic(err)
+	}
+
+	logInfo("maximum buffer size", map[string]interface{}{"bytesToCheck": server.BytesToCheck})
+
+	l, err := net.Listen("tcp", conf.Address)
+	if err != nil {
+		logInfo("listen failed", map[string]interface{}{"address": conf.Address, "err": err})
+		panic(err)
+	}
+
+	logInfo("listening", map[string]interface{}{"address": conf.Address})
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			logInfo("received SIGHUP, reloading configuration", nil)
+			if err := reloadConfig(); err != nil {
+				logInfo("reloading configuration failed", map[string]interface{}{"err": err})
+			}
 		}
+	}()
+
+	if conf.ControlSocket != "" {
+		go serveControlSocket(conf.ControlSocket)
 	}
 
 	if server.DefaultProtocol != nil {
-		logit("Default protocol set to: %v", server.DefaultProtocol)
+		logInfo("default protocol set", map[string]interface{}{"protocol": fmt.Sprintf("%v", server.DefaultProtocol)})
 	}
 
 	server.Serve(l)